@@ -0,0 +1,145 @@
+package exec
+
+import (
+	"context"
+	"math"
+
+	"github.com/placeybordeaux-remitly/graphql-go/errors"
+	"github.com/placeybordeaux-remitly/graphql-go/internal/common"
+	"github.com/placeybordeaux-remitly/graphql-go/internal/exec/resolvable"
+	"github.com/placeybordeaux-remitly/graphql-go/internal/exec/selected"
+)
+
+// ComplexityConfig bounds the cost of a single operation. It's checked by
+// Validate before Execute spawns any resolver goroutines, so an abusive
+// query is rejected up front instead of partway through resolution.
+type ComplexityConfig struct {
+	// MaxComplexity is the maximum total cost an operation may accumulate
+	// across every selected field. Zero means unlimited.
+	MaxComplexity int
+	// MaxDepth is the maximum selection set nesting depth allowed. Zero
+	// means unlimited.
+	MaxDepth int
+	// DefaultFieldCost is charged for every field when FieldCost is nil.
+	// Defaults to 1 when left at the zero value.
+	DefaultFieldCost int
+	// FieldCost, when set, is called for every field in place of
+	// DefaultFieldCost, keyed by the type and field it belongs to and given
+	// its packed arguments; whatever it returns is that field's cost, and
+	// DefaultFieldCost is not consulted. This mirrors Request.FieldTimeout: resolvable.Field doesn't
+	// carry its own per-field cost, so overrides are supplied by the caller
+	// instead of being discovered via reflection on the resolver.
+	FieldCost func(typeName, fieldName string, args map[string]interface{}) int
+}
+
+// fanoutArgNames are checked, in order, for an integer argument to use as a
+// list field's fan-out multiplier when estimating cost.
+var fanoutArgNames = []string{"first", "last", "limit"}
+
+// Validate walks the selection set an operation would execute and rejects
+// it before Execute runs a single resolver if it exceeds cfg's limits. A
+// zero ComplexityConfig always passes.
+func Validate(ctx context.Context, s *resolvable.Schema, sels []selected.Selection, cfg ComplexityConfig) *errors.QueryError {
+	if cfg.MaxComplexity == 0 && cfg.MaxDepth == 0 {
+		return nil
+	}
+	defaultCost := cfg.DefaultFieldCost
+	if defaultCost == 0 {
+		defaultCost = 1
+	}
+
+	var walk func(sels []selected.Selection, path *pathSegment, depth int) (int, *errors.QueryError)
+	walk = func(sels []selected.Selection, path *pathSegment, depth int) (int, *errors.QueryError) {
+		if cfg.MaxDepth > 0 && depth > cfg.MaxDepth {
+			err := errors.Errorf("query exceeds max depth of %d", cfg.MaxDepth)
+			err.Path = path.toSlice()
+			return 0, err
+		}
+
+		total := 0
+		for _, sel := range sels {
+			switch sel := sel.(type) {
+			case *selected.SchemaField:
+				fieldPath := &pathSegment{path, sel.Alias}
+
+				cost := defaultCost
+				if cfg.FieldCost != nil {
+					cost = cfg.FieldCost(sel.TypeName, sel.Name, sel.Args)
+				}
+
+				childCost, err := walk(sel.Sels, fieldPath, depth+1)
+				if err != nil {
+					return 0, err
+				}
+
+				// A paginated list field doesn't just cost more itself, it
+				// multiplies the cost of everything selected underneath it
+				// too: `users(first: 100000) { orders { items { price } } }`
+				// resolves the orders/items/price subselection 100000 times
+				// over, not once, so scaling only the field's own cost and
+				// not childCost would let exactly this shape through any
+				// reasonable MaxComplexity.
+				n := 1
+				if fieldType, _ := unwrapNonNull(sel.Type); isListType(fieldType) {
+					n = fanout(sel.Args)
+				}
+				sum := cost + childCost
+
+				// Fan-out compounds multiplicatively at every nested list
+				// level, so a few levels of large first/last arguments can
+				// overflow total well before any reasonable MaxComplexity is
+				// reached. Treat an overflowing multiplication as exceeding
+				// the limit rather than letting it wrap around to a small or
+				// negative value that would sail past the check below.
+				if cfg.MaxComplexity > 0 && n > 1 && sum > 0 && sum > math.MaxInt/n {
+					err := errors.Errorf("query exceeds max complexity of %d", cfg.MaxComplexity)
+					err.Path = fieldPath.toSlice()
+					return 0, err
+				}
+				total += n * sum
+
+				if cfg.MaxComplexity > 0 && total > cfg.MaxComplexity {
+					err := errors.Errorf("query exceeds max complexity of %d", cfg.MaxComplexity)
+					err.Path = fieldPath.toSlice()
+					return 0, err
+				}
+
+			case *selected.TypeAssertion:
+				childCost, err := walk(sel.Sels, path, depth)
+				if err != nil {
+					return 0, err
+				}
+				total += childCost
+			}
+		}
+		return total, nil
+	}
+
+	_, err := walk(sels, nil, 0)
+	return err
+}
+
+// isListType reports whether t is a list type. Callers must unwrapNonNull
+// first: a paginated field's real-world type is almost always NonNull(List(...))
+// rather than a bare List, since list arguments like `first`/`last` are
+// usually only meaningful on a field that can't itself resolve to null.
+func isListType(t common.Type) bool {
+	_, ok := t.(*common.List)
+	return ok
+}
+
+// fanout estimates how many times a list field multiplies the cost of its
+// children, based on whichever pagination argument it declares.
+func fanout(args map[string]interface{}) int {
+	for _, name := range fanoutArgNames {
+		if v, ok := args[name]; ok {
+			if n, ok := v.(int32); ok && n > 0 {
+				return int(n)
+			}
+			if n, ok := v.(int); ok && n > 0 {
+				return n
+			}
+		}
+	}
+	return 1
+}
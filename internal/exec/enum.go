@@ -0,0 +1,80 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/placeybordeaux-remitly/graphql-go/errors"
+	"github.com/placeybordeaux-remitly/graphql-go/internal/schema"
+)
+
+// EnumMarshaler is implemented by resolver types that want full control
+// over how they serialize to a GraphQL enum value, without having to
+// satisfy fmt.Stringer. It takes priority over json.Marshaler and
+// fmt.Stringer in enumName's resolution order.
+type EnumMarshaler interface {
+	MarshalGQL() string
+}
+
+// enumName determines the string a resolved enum value should serialize as,
+// trying in order: EnumMarshaler, json.Marshaler, fmt.Stringer, and finally
+// the underlying value itself: a string-kind value is matched directly
+// against a member name, and an int-kind value is taken as the member's
+// ordinal position in t.Values.
+// This lets users declare enums as plain typed int/string constants without
+// hand-writing a String() method, which is what codegen tools that emit
+// MarshalJSON for enums tend to produce.
+func enumName(resolver reflect.Value, t *schema.Enum) (string, *errors.QueryError) {
+	var name string
+	switch v := resolver.Interface().(type) {
+	case EnumMarshaler:
+		name = v.MarshalGQL()
+
+	case json.Marshaler:
+		data, err := v.MarshalJSON()
+		if err != nil {
+			return "", errors.Errorf("could not marshal enum value: %s", err)
+		}
+		if err := json.Unmarshal(data, &name); err != nil {
+			return "", errors.Errorf("enum value's MarshalJSON must produce a JSON string: %s", err)
+		}
+
+	case fmt.Stringer:
+		name = v.String()
+
+	default:
+		// No EnumMarshaler, json.Marshaler or Stringer: accept a plain typed
+		// int/string constant. A string-kind value is matched against a
+		// member name directly; an int-kind value is treated as the
+		// member's ordinal position in t.Values, which is what Go's
+		// `iota`-based enum constants (and the codegen tools that emit
+		// them) actually encode — the constant's numeric value was never
+		// going to match a member's name as a string.
+		switch resolver.Kind() {
+		case reflect.String:
+			name = resolver.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			ordinal := int(resolver.Convert(reflect.TypeOf(int64(0))).Int())
+			if ordinal < 0 || ordinal >= len(t.Values) {
+				return "", errors.Errorf("Invalid value %d.\nExpected type %s, which has %d values", ordinal, t.Name, len(t.Values))
+			}
+			return t.Values[ordinal].Name, nil
+		default:
+			name = fmt.Sprintf("%v", resolver.Interface())
+		}
+	}
+
+	for _, v := range t.Values {
+		if v.Name == name {
+			return name, nil
+		}
+	}
+	valid := make([]string, len(t.Values))
+	for i, v := range t.Values {
+		valid[i] = v.Name
+	}
+	return "", errors.Errorf("Invalid value %s.\nExpected type %s, found %s. Valid values are: %s", name, t.Name, name, strings.Join(valid, ", "))
+}
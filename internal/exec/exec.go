@@ -15,22 +15,56 @@ import (
 	"github.com/placeybordeaux-remitly/graphql-go/internal/exec/selected"
 	"github.com/placeybordeaux-remitly/graphql-go/internal/query"
 	"github.com/placeybordeaux-remitly/graphql-go/internal/schema"
+	"github.com/placeybordeaux-remitly/graphql-go/loader"
 	"github.com/placeybordeaux-remitly/graphql-go/log"
 	"github.com/placeybordeaux-remitly/graphql-go/trace"
 )
 
+// NewLoaderRegistry creates the per-request loader.Registry that Request.Loaders
+// should be set to when any resolver in the schema is loader-backed. maxBatchSize
+// and maxWait should normally come from Request.LoaderMaxBatchSize and
+// Request.LoaderMaxWait; they're passed in explicitly here (rather than read
+// off a *Request) because the registry is typically built once, before the
+// Request carrying it even exists.
+func NewLoaderRegistry(maxBatchSize int, maxWait time.Duration) *loader.Registry {
+	return loader.NewRegistry(loader.Config{MaxBatchSize: maxBatchSize, MaxWait: maxWait})
+}
+
 type Request struct {
 	selected.Request
 	Limiter                  chan struct{}
 	Tracer                   trace.Tracer
 	Logger                   log.Logger
 	SubscribeResolverTimeout time.Duration
+	Loaders                  *loader.Registry
+	// LoaderMaxBatchSize and LoaderMaxWait are the values the Registry
+	// assigned to Loaders should have been constructed with via
+	// NewLoaderRegistry; kept here so callers have one place to look up what
+	// a request's batching behavior is configured to be.
+	LoaderMaxBatchSize int
+	LoaderMaxWait      time.Duration
+	Complexity         ComplexityConfig
+	// FieldTimeout, when set, returns the deadline a single field's resolver
+	// is given, keyed by the type and field it belongs to. A zero duration
+	// means the field inherits whatever's left on the parent context.
+	FieldTimeout func(typeName, fieldName string) time.Duration
+	// DeferredPaths marks which fields, identified by their dotted response
+	// path (e.g. "user.profile"), were selected with an `@defer` directive,
+	// mapping to the directive's label. It's populated by the caller from
+	// the parsed operation; nothing in this package recognizes `@defer`
+	// from the query itself.
+	DeferredPaths map[string]string
+	// StreamedPaths marks which list fields were selected with an `@stream`
+	// directive, mapping their dotted response path to the directive's
+	// initialCount argument (how many leading elements ship in the initial
+	// response before streaming kicks in).
+	StreamedPaths map[string]int
 }
 
-func (r *Request) handlePanic(ctx context.Context) {
+func (r *Request) handlePanic(ctx context.Context, addErr func(*errors.QueryError)) {
 	if value := recover(); value != nil {
 		r.Logger.LogPanic(ctx, value)
-		r.AddError(makePanicError(value))
+		addErr(makePanicError(value))
 	}
 }
 
@@ -45,17 +79,20 @@ func makePanicError(value interface{}) *errors.QueryError {
 func (r *Request) Execute(ctx context.Context, s *resolvable.Schema, op *query.Operation) ([]byte, []*errors.QueryError) {
 	var out bytes.Buffer
 	func() {
-		defer r.handlePanic(ctx)
+		defer r.handlePanic(ctx, r.AddError)
 		sels := selected.ApplyOperation(&r.Request, s, op)
-		r.execSelections(ctx, sels, nil, s, s.Resolver, &out, op.Type == query.Mutation)
+		if err := Validate(ctx, s, sels, r.Complexity); err != nil {
+			r.AddError(err)
+			return
+		}
+		r.execSelections(ctx, sels, nil, s, s.Resolver, &out, op.Type == query.Mutation, r.AddError, nil)
 	}()
 
-	if err := ctx.Err(); err != nil {
-		//If context has either been cancelled or timed out we still may want to return the features that have finished
-		// TODO properly attribute mark which features have timedout in the error field
-		return out.Bytes(), r.Errs
-	}
-
+	// If the root context has been cancelled or timed out, whatever fields
+	// finished in time are still in out/r.Errs; each unfinished field's own
+	// derived context recorded which of them actually timed out (see
+	// execSelections and fieldTimeoutError), so there's nothing left to
+	// attribute here.
 	return out.Bytes(), r.Errs
 }
 
@@ -66,28 +103,70 @@ type fieldToExec struct {
 	out      *bytes.Buffer
 	lock     sync.Mutex
 	finished bool
+	// ctx is the context execFieldSelection actually ran under: either the
+	// parent selection's context, or one derived from it with a deadline set
+	// via Request.FieldTimeout. Its Err(), not the parent ctx's, is what
+	// tells us whether this specific field timed out.
+	ctx context.Context
 }
 
 func resolvedToNull(b *bytes.Buffer) bool {
 	return bytes.Equal(b.Bytes(), []byte("null"))
 }
 
-func (r *Request) execSelections(ctx context.Context, sels []selected.Selection, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer, serially bool) {
+// incState carries the plumbing needed to support @defer/@stream through a
+// single execSelections/execSelectionSet/execList recursion. A nil *incState
+// means this call tree is a plain Execute and all of the code below guarded
+// by "inc != nil" is skipped, so Execute's behavior is unchanged.
+type incState struct {
+	patches chan<- *IncrementalPatch
+	pending *sync.WaitGroup
+	// started counts how many fields/elements were actually pulled out for
+	// deferred/streamed resolution. It's what ExecuteIncremental uses to
+	// decide whether the initial response's hasNext is true, and whether
+	// the patches channel has anything coming at all.
+	started int32
+}
+
+func (r *Request) execSelections(ctx context.Context, sels []selected.Selection, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer, serially bool, addErr func(*errors.QueryError), inc *incState) {
 	async := !serially && selected.HasAsyncSel(sels)
 
 	var fields []*fieldToExec
 	collectFieldsToResolve(sels, s, resolver, &fields, make(map[string]*fieldToExec))
 
+	if inc != nil {
+		kept := fields[:0]
+		for _, f := range fields {
+			fieldPath := &pathSegment{path, f.field.Alias}
+			if label, ok := r.deferLabel(dottedPath(fieldPath)); ok {
+				r.execDeferredSelection(ctx, s, f, fieldPath, label, inc)
+				continue
+			}
+			kept = append(kept, f)
+		}
+		fields = kept
+	}
+
 	if async {
 		var wg sync.WaitGroup
 		wg.Add(len(fields))
 		for _, f := range fields {
-			go func(f *fieldToExec) {
+			fieldCtx, cancel := r.withFieldTimeout(ctx, f.field.TypeName, f.field.Name)
+			f.ctx = fieldCtx
+			go func(f *fieldToExec, fieldCtx context.Context, cancel context.CancelFunc) {
+				defer cancel()
 				defer wg.Done()
-				defer r.handlePanic(ctx)
+				defer r.handlePanic(fieldCtx, addErr)
 				f.out = new(bytes.Buffer)
-				execFieldSelection(ctx, r, s, f, &pathSegment{path, f.field.Alias}, true)
-			}(f)
+				execFieldSelection(fieldCtx, r, s, f, &pathSegment{path, f.field.Alias}, true, addErr, inc, nil)
+			}(f, fieldCtx, cancel)
+		}
+		// All sibling goroutines are spawned and have had a chance to enqueue
+		// loader keys before blocking on their resolver; dispatch now so their
+		// BatchLoad calls run concurrently with one another rather than
+		// serially per resolver.
+		if r.Loaders != nil {
+			r.Loaders.Dispatch(ctx)
 		}
 		// close a signal channel once the wait group is complete
 		done := make(chan struct{})
@@ -102,8 +181,17 @@ func (r *Request) execSelections(ctx context.Context, sels []selected.Selection,
 		}
 	} else {
 		for _, f := range fields {
+			fieldCtx, cancel := r.withFieldTimeout(ctx, f.field.TypeName, f.field.Name)
+			f.ctx = fieldCtx
 			f.out = new(bytes.Buffer)
-			execFieldSelection(ctx, r, s, f, &pathSegment{path, f.field.Alias}, true)
+			// There are no siblings to batch with in the serial path (each
+			// field fully resolves, including any nested selections, before
+			// the next one starts), so a loader-backed resolver here would
+			// block forever on its enqueued key if nothing ever dispatched
+			// it; dispatch immediately after it enqueues instead of waiting
+			// for a batch that will never arrive.
+			execFieldSelectionSelfDispatching(fieldCtx, r, s, f, &pathSegment{path, f.field.Alias}, addErr, inc)
+			cancel()
 		}
 	}
 
@@ -117,9 +205,8 @@ func (r *Request) execSelections(ctx context.Context, sels []selected.Selection,
 			out.Reset()
 			out.Write([]byte("null"))
 			if !f.finished { // if we haven't finished yet that means we haven't recorded this failure yet
-				err := errors.Errorf(ctx.Err().Error())
-				err.Path = append(path.toSlice(), f.field.Alias)
-				r.AddError(err)
+				err := fieldTimeoutError(f.ctx, ctx, append(path.toSlice(), f.field.Alias))
+				addErr(err)
 			}
 			f.lock.Unlock()
 			return
@@ -132,11 +219,11 @@ func (r *Request) execSelections(ctx context.Context, sels []selected.Selection,
 		out.WriteString(f.field.Alias)
 		out.WriteByte('"')
 		out.WriteByte(':')
-		// if this field hasn't finished yet, then it's timed out. Record it as null
+		// if this field hasn't finished yet, then it timed out or its parent
+		// was cancelled; record which one happened and name the field.
 		if !f.finished {
-			err := errors.Errorf(ctx.Err().Error())
-			err.Path = append(path.toSlice(), f.field.Alias)
-			r.AddError(err)
+			err := fieldTimeoutError(f.ctx, ctx, append(path.toSlice(), f.field.Alias))
+			addErr(err)
 			out.WriteString("null")
 			continue
 		}
@@ -146,6 +233,48 @@ func (r *Request) execSelections(ctx context.Context, sels []selected.Selection,
 	out.WriteByte('}')
 }
 
+// withFieldTimeout derives a per-field context from parent according to
+// Request.FieldTimeout, if configured. When no timeout applies it returns
+// parent unchanged and a no-op cancel, so callers can unconditionally defer
+// cancel() either way.
+func (r *Request) withFieldTimeout(parent context.Context, typeName, fieldName string) (context.Context, context.CancelFunc) {
+	if r.FieldTimeout == nil {
+		return parent, func() {}
+	}
+	d := r.FieldTimeout(typeName, fieldName)
+	if d <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, d)
+}
+
+// fieldTimeoutError builds the error recorded for a field that never
+// finished. It distinguishes a deadline being exceeded (TIMEOUT) from
+// cancellation (CANCELLED), and always names the field via path so it's
+// clear which resolver is responsible. Because the field's context is
+// derived from the parent's, a field's own deadline and an inherited parent
+// deadline both produce the same TIMEOUT error.
+func fieldTimeoutError(fieldCtx, parentCtx context.Context, path []interface{}) *errors.QueryError {
+	fieldErr := fieldCtx.Err()
+	if fieldErr == nil {
+		fieldErr = parentCtx.Err()
+	}
+
+	var err *errors.QueryError
+	switch fieldErr {
+	case context.DeadlineExceeded:
+		err = errors.Errorf("field did not complete within its timeout")
+		err.Extensions = map[string]interface{}{"code": "TIMEOUT"}
+	case context.Canceled:
+		err = errors.Errorf("field resolution was cancelled")
+		err.Extensions = map[string]interface{}{"code": "CANCELLED"}
+	default:
+		err = errors.Errorf("field did not complete: %v", fieldErr)
+	}
+	err.Path = path
+	return err
+}
+
 func collectFieldsToResolve(sels []selected.Selection, s *resolvable.Schema, resolver reflect.Value, fields *[]*fieldToExec, fieldByAlias map[string]*fieldToExec) {
 	for _, sel := range sels {
 		switch sel := sel.(type) {
@@ -192,7 +321,53 @@ func typeOf(tf *selected.TypenameField, resolver reflect.Value) string {
 	return ""
 }
 
-func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f *fieldToExec, path *pathSegment, applyLimiter bool) {
+// execFieldSelectionSelfDispatching resolves a field the way the serial
+// (non-async) path in execSelections does: there are no siblings it could
+// batch a loader call with, so as soon as the resolver enqueues a key it
+// dispatches that batch itself instead of relying on a caller to do it once
+// for a whole set of siblings, the way the async path does.
+//
+// Dispatch must not run until the field's goroutine has actually reached
+// Loaders.Enqueue: calling it right after "go func(){...}()" only works
+// when the scheduler happens to run the new goroutine up to its Enqueue
+// before the caller reaches Dispatch, which is not a guarantee, and
+// otherwise leaves the key sitting in the registry's *next* pending batch
+// with nothing left to ever dispatch
+// it — a permanent hang. ready is closed exactly once, either by
+// execFieldSelection right after it enqueues, or by the goroutine's own
+// completion if it never reaches a loader call at all, so Dispatch always
+// waits for the one event that tells it there's (or definitely isn't)
+// something to pick up.
+func execFieldSelectionSelfDispatching(ctx context.Context, r *Request, s *resolvable.Schema, f *fieldToExec, path *pathSegment, addErr func(*errors.QueryError), inc *incState) {
+	if r.Loaders == nil {
+		execFieldSelection(ctx, r, s, f, path, true, addErr, inc, nil)
+		return
+	}
+
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	signalReady := func() { readyOnce.Do(func() { close(ready) }) }
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer signalReady()
+		execFieldSelection(ctx, r, s, f, path, true, addErr, inc, signalReady)
+	}()
+	<-ready
+	r.Loaders.Dispatch(ctx)
+	<-done
+}
+
+// execFieldSelection resolves a single field. If the field's resolver
+// returns a loader.Thunk, onEnqueue (if non-nil) is called immediately
+// after the key is handed to Loaders.Enqueue, before blocking on the
+// result — giving a caller like execFieldSelectionSelfDispatching a signal
+// that it's now safe to call Dispatch. Pass nil when the caller already
+// knows Dispatch will be triggered some other way (e.g. the async path in
+// execSelections, which dispatches once after every sibling goroutine has
+// been spawned).
+func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f *fieldToExec, path *pathSegment, applyLimiter bool, addErr func(*errors.QueryError), inc *incState, onEnqueue func()) {
 	if applyLimiter {
 		r.Limiter <- struct{}{}
 	}
@@ -222,8 +397,10 @@ func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f
 			return nil
 		}
 
-		if err := traceCtx.Err(); err != nil {
-			return errors.Errorf("%s", err) // don't execute any more resolvers if context got cancelled
+		if traceCtx.Err() != nil {
+			// Don't execute any more resolvers if the field's (or an ancestor's)
+			// context is already done; name which one it was via path.
+			return fieldTimeoutError(traceCtx, ctx, path.toSlice())
 		}
 
 		res := f.resolver
@@ -254,6 +431,30 @@ func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f
 			}
 			result = res.FieldByIndex(f.field.FieldIndex)
 		}
+
+		if thunk, ok := result.Interface().(loader.Thunk); ok {
+			if r.Loaders == nil {
+				err := errors.Errorf("field %q returned a loader.Thunk but Request.Loaders is nil; set Request.Loaders to a *loader.Registry to use loader-backed resolvers", f.field.Name)
+				err.Path = path.toSlice()
+				return err
+			}
+			resChan := r.Loaders.Enqueue(thunk.Loader(), thunk.Key())
+			if onEnqueue != nil {
+				onEnqueue()
+			}
+			select {
+			case res := <-resChan:
+				if res.Err != nil {
+					err := errors.Errorf("%s", res.Err)
+					err.Path = path.toSlice()
+					err.ResolverError = res.Err
+					return err
+				}
+				result = reflect.ValueOf(res.Value)
+			case <-traceCtx.Done():
+				return errors.Errorf("%s", traceCtx.Err())
+			}
+		}
 		return nil
 	}()
 
@@ -264,7 +465,7 @@ func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f
 	if err != nil {
 		// If an error occurred while resolving a field, it should be treated as though the field
 		// returned null, and an error must be added to the "errors" list in the response.
-		r.AddError(err)
+		addErr(err)
 		f.lock.Lock()
 		f.out.WriteString("null")
 		f.lock.Unlock()
@@ -272,11 +473,11 @@ func execFieldSelection(ctx context.Context, r *Request, s *resolvable.Schema, f
 	}
 
 	f.lock.Lock()
-	r.execSelectionSet(traceCtx, f.sels, f.field.Type, path, s, result, f.out)
+	r.execSelectionSet(traceCtx, f.sels, f.field.Type, path, s, result, f.out, addErr, inc)
 	f.lock.Unlock()
 }
 
-func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selection, typ common.Type, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer) {
+func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selection, typ common.Type, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer, addErr func(*errors.QueryError), inc *incState) {
 	t, nonNull := unwrapNonNull(typ)
 
 	// a reflect.Value of a nil interface will show up as an Invalid value
@@ -287,7 +488,7 @@ func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selectio
 		if nonNull {
 			err := errors.Errorf("graphql: got nil for non-null %q", t)
 			err.Path = path.toSlice()
-			r.AddError(err)
+			addErr(err)
 		}
 		out.WriteString("null")
 		return
@@ -295,7 +496,7 @@ func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selectio
 
 	switch t.(type) {
 	case *schema.Object, *schema.Interface, *schema.Union:
-		r.execSelections(ctx, sels, path, s, resolver, out, false)
+		r.execSelections(ctx, sels, path, s, resolver, out, false, addErr, inc)
 		return
 	}
 
@@ -307,7 +508,7 @@ func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selectio
 
 	switch t := t.(type) {
 	case *common.List:
-		r.execList(ctx, sels, t, path, s, resolver, out)
+		r.execList(ctx, sels, t, path, s, resolver, out, addErr, inc)
 
 	case *schema.Scalar:
 		v := resolver.Interface()
@@ -318,22 +519,10 @@ func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selectio
 		out.Write(data)
 
 	case *schema.Enum:
-		var stringer fmt.Stringer = resolver
-		if s, ok := resolver.Interface().(fmt.Stringer); ok {
-			stringer = s
-		}
-		name := stringer.String()
-		var valid bool
-		for _, v := range t.Values {
-			if v.Name == name {
-				valid = true
-				break
-			}
-		}
-		if !valid {
-			err := errors.Errorf("Invalid value %s.\nExpected type %s, found %s.", name, t.Name, name)
+		name, err := enumName(resolver, t)
+		if err != nil {
 			err.Path = path.toSlice()
-			r.AddError(err)
+			addErr(err)
 			out.WriteString("null")
 			return
 		}
@@ -346,32 +535,52 @@ func (r *Request) execSelectionSet(ctx context.Context, sels []selected.Selectio
 	}
 }
 
-func (r *Request) execList(ctx context.Context, sels []selected.Selection, typ *common.List, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer) {
+func (r *Request) execList(ctx context.Context, sels []selected.Selection, typ *common.List, path *pathSegment, s *resolvable.Schema, resolver reflect.Value, out *bytes.Buffer, addErr func(*errors.QueryError), inc *incState) {
 	l := resolver.Len()
-	entryouts := make([]bytes.Buffer, l)
+	initialCount := l
+	if inc != nil {
+		if n, ok := r.streamInitialCount(dottedPath(path)); ok && n < l {
+			initialCount = n
+		}
+	}
+	entryouts := make([]bytes.Buffer, initialCount)
 
-	if selected.HasAsyncSel(sels) {
+	async := selected.HasAsyncSel(sels)
+	concurrency := 1
+	if async {
+		concurrency = cap(r.Limiter)
+		if concurrency > initialCount {
+			concurrency = initialCount
+		}
+	}
+	batchCtx, finishBatch := r.Tracer.TraceBatch(ctx, fmt.Sprint(path.value), initialCount, concurrency)
+	defer finishBatch()
+
+	if async {
 		// Limit the number of concurrent goroutines spawned as it can lead to large
 		// memory spikes for large lists.
-		concurrency := cap(r.Limiter)
-		sem := make(chan struct{}, concurrency)
-		for i := 0; i < l; i++ {
+		sem := make(chan struct{}, cap(r.Limiter))
+		for i := 0; i < initialCount; i++ {
 			sem <- struct{}{}
 			go func(i int) {
 				defer func() { <-sem }()
-				defer r.handlePanic(ctx)
-				r.execSelectionSet(ctx, sels, typ.OfType, &pathSegment{path, i}, s, resolver.Index(i), &entryouts[i])
+				defer r.handlePanic(batchCtx, addErr)
+				r.execSelectionSet(batchCtx, sels, typ.OfType, &pathSegment{path, i}, s, resolver.Index(i), &entryouts[i], addErr, inc)
 			}(i)
 		}
-		for i := 0; i < concurrency; i++ {
+		for i := 0; i < cap(r.Limiter); i++ {
 			sem <- struct{}{}
 		}
 	} else {
-		for i := 0; i < l; i++ {
-			r.execSelectionSet(ctx, sels, typ.OfType, &pathSegment{path, i}, s, resolver.Index(i), &entryouts[i])
+		for i := 0; i < initialCount; i++ {
+			r.execSelectionSet(batchCtx, sels, typ.OfType, &pathSegment{path, i}, s, resolver.Index(i), &entryouts[i], addErr, inc)
 		}
 	}
 
+	if initialCount < l {
+		r.execStreamedList(ctx, sels, typ, path, s, resolver, initialCount, inc)
+	}
+
 	_, listOfNonNull := typ.OfType.(*common.NonNull)
 
 	out.WriteByte('[')
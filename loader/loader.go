@@ -0,0 +1,204 @@
+// Package loader provides a DataLoader-style batching hook that the exec
+// engine uses to coalesce sibling field resolutions into a single call,
+// eliminating the N+1 resolver calls that naive per-field resolution
+// produces for list fields.
+package loader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Loader batches individual key lookups requested by resolvers within a
+// single request into one BatchLoad call. Implementations are typically
+// backed by a cache scoped to the request so that repeated keys within the
+// same operation are only loaded once.
+type Loader interface {
+	// BatchLoad resolves keys in the order they were given, returning one
+	// result (or error) per key.
+	BatchLoad(ctx context.Context, keys []interface{}) ([]interface{}, []error)
+}
+
+// request is a single pending key registered against a Loader, waiting to
+// be picked up by the next Dispatch. Multiple Enqueue calls for the same
+// key against the same Loader share one request so the key is only sent to
+// BatchLoad once.
+type request struct {
+	key     interface{}
+	waiters []chan<- Result
+}
+
+// Result is delivered back to the resolver that enqueued a key once the
+// owning Loader's batch has been dispatched.
+type Result struct {
+	Value interface{}
+	Err   error
+}
+
+// Thunk is returned by a loader-backed resolver method in place of its real
+// result. The exec engine recognizes this return type, enqueues Key() on
+// Loader() against the request's Registry instead of resolving the field
+// right away, and substitutes the batched Result once Dispatch runs.
+type Thunk interface {
+	Loader() Loader
+	Key() interface{}
+}
+
+// Config bounds how a Registry batches the keys enqueued against it over
+// the lifetime of a single request.
+type Config struct {
+	// MaxBatchSize caps how many keys a single BatchLoad call receives; a
+	// Loader with more keys pending than this is dispatched as multiple
+	// BatchLoad calls instead of one. Zero means unlimited.
+	MaxBatchSize int
+	// MaxWait bounds how long Dispatch holds off taking its pending
+	// snapshot, giving keys enqueued concurrently with the Dispatch call a
+	// short window to join the batch that's about to go out instead of
+	// missing it and starting a batch of their own on the next Dispatch.
+	// Zero means Dispatch only picks up keys enqueued before it was called.
+	MaxWait time.Duration
+}
+
+// Registry collects the keys enqueued by loader-backed resolvers over the
+// course of resolving a single request's selection set, caches results by
+// key so that a key repeated within the same operation is only loaded once,
+// and dispatches one or more BatchLoad calls per Loader rather than one call
+// per resolver invocation. A Registry is created per exec.Request and must
+// not be shared across requests, since its cache has no notion of which
+// operation a key belongs to.
+type Registry struct {
+	cfg Config
+
+	mu      sync.Mutex
+	pending map[Loader]map[interface{}]*request
+	cache   map[Loader]map[interface{}]Result
+}
+
+// NewRegistry returns an empty Registry ready to accept enqueued keys,
+// batching and caching according to cfg.
+func NewRegistry(cfg Config) *Registry {
+	return &Registry{
+		cfg:     cfg,
+		pending: make(map[Loader]map[interface{}]*request),
+		cache:   make(map[Loader]map[interface{}]Result),
+	}
+}
+
+// Enqueue registers key against l and returns a channel that receives
+// exactly one Result once Dispatch has run l's batch. Enqueue is safe to
+// call from multiple goroutines, which is the common case since sibling
+// fields are typically resolved concurrently. If key has already been
+// resolved against l earlier in the same request, or is already pending
+// dispatch, Enqueue reuses that outcome instead of loading it again.
+func (reg *Registry) Enqueue(l Loader, key interface{}) <-chan Result {
+	out := make(chan Result, 1)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if cached, ok := reg.cache[l]; ok {
+		if res, ok := cached[key]; ok {
+			out <- res
+			close(out)
+			return out
+		}
+	}
+
+	reqs, ok := reg.pending[l]
+	if !ok {
+		reqs = make(map[interface{}]*request)
+		reg.pending[l] = reqs
+	}
+	if req, ok := reqs[key]; ok {
+		req.waiters = append(req.waiters, out)
+		return out
+	}
+	reqs[key] = &request{key: key, waiters: []chan<- Result{out}}
+	return out
+}
+
+// Dispatch calls BatchLoad once for every Loader that had keys enqueued
+// since the last Dispatch, splitting a Loader's pending keys across
+// multiple BatchLoad calls if there are more of them than cfg.MaxBatchSize,
+// fans the results back out to the channels returned by Enqueue, and caches
+// them so a later Enqueue of the same key against the same Loader doesn't
+// trigger another BatchLoad. It's called by the exec engine after all of a
+// selection set's sibling goroutines have been spawned but before it waits
+// on them, so that loader-backed resolvers block on their result channel
+// instead of calling through to the backing store individually.
+func (reg *Registry) Dispatch(ctx context.Context) {
+	if reg.cfg.MaxWait > 0 {
+		select {
+		case <-time.After(reg.cfg.MaxWait):
+		case <-ctx.Done():
+		}
+	}
+
+	reg.mu.Lock()
+	pending := reg.pending
+	reg.pending = make(map[Loader]map[interface{}]*request)
+	reg.mu.Unlock()
+
+	for l, reqs := range pending {
+		if len(reqs) == 0 {
+			continue
+		}
+		l := l
+		all := make([]*request, 0, len(reqs))
+		for _, req := range reqs {
+			all = append(all, req)
+		}
+
+		batchSize := reg.cfg.MaxBatchSize
+		if batchSize <= 0 {
+			batchSize = len(all)
+		}
+		for start := 0; start < len(all); start += batchSize {
+			end := start + batchSize
+			if end > len(all) {
+				end = len(all)
+			}
+			batch := all[start:end]
+			go reg.dispatchBatch(ctx, l, batch)
+		}
+	}
+}
+
+// dispatchBatch runs a single BatchLoad call for batch, caches each key's
+// Result against l, and fans it out to every waiter that enqueued that key.
+func (reg *Registry) dispatchBatch(ctx context.Context, l Loader, batch []*request) {
+	keys := make([]interface{}, len(batch))
+	for i, req := range batch {
+		keys[i] = req.key
+	}
+	values, errs := l.BatchLoad(ctx, keys)
+
+	results := make([]Result, len(batch))
+	for i := range batch {
+		if i < len(values) {
+			results[i].Value = values[i]
+		}
+		if i < len(errs) {
+			results[i].Err = errs[i]
+		}
+	}
+
+	reg.mu.Lock()
+	cache, ok := reg.cache[l]
+	if !ok {
+		cache = make(map[interface{}]Result)
+		reg.cache[l] = cache
+	}
+	for i, req := range batch {
+		cache[req.key] = results[i]
+	}
+	reg.mu.Unlock()
+
+	for i, req := range batch {
+		for _, w := range req.waiters {
+			w <- results[i]
+			close(w)
+		}
+	}
+}
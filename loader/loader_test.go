@@ -0,0 +1,174 @@
+package loader
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLoader struct {
+	mu    sync.Mutex
+	calls [][]interface{}
+}
+
+func (l *recordingLoader) BatchLoad(ctx context.Context, keys []interface{}) ([]interface{}, []error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, append([]interface{}{}, keys...))
+	l.mu.Unlock()
+
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = k
+	}
+	return values, make([]error, len(keys))
+}
+
+func (l *recordingLoader) callCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.calls)
+}
+
+func TestRegistryBatchesConcurrentEnqueues(t *testing.T) {
+	l := &recordingLoader{}
+	reg := NewRegistry(Config{})
+
+	var chans []<-chan Result
+	for i := 0; i < 5; i++ {
+		chans = append(chans, reg.Enqueue(l, i))
+	}
+	reg.Dispatch(context.Background())
+
+	for i, ch := range chans {
+		res := <-ch
+		if res.Value != i {
+			t.Errorf("key %d: got value %v, want %d", i, res.Value, i)
+		}
+	}
+	if got := l.callCount(); got != 1 {
+		t.Errorf("BatchLoad called %d times, want 1", got)
+	}
+}
+
+func TestRegistryCachesRepeatedKey(t *testing.T) {
+	l := &recordingLoader{}
+	reg := NewRegistry(Config{})
+
+	first := reg.Enqueue(l, "a")
+	reg.Dispatch(context.Background())
+	if res := <-first; res.Value != "a" {
+		t.Fatalf("got value %v, want %q", res.Value, "a")
+	}
+
+	second := reg.Enqueue(l, "a")
+	select {
+	case res := <-second:
+		if res.Value != "a" {
+			t.Errorf("got value %v, want %q", res.Value, "a")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue of a cached key should resolve without another Dispatch")
+	}
+
+	if got := l.callCount(); got != 1 {
+		t.Errorf("BatchLoad called %d times, want 1 (second key should have hit the cache)", got)
+	}
+}
+
+func TestRegistrySplitsBatchesAtMaxBatchSize(t *testing.T) {
+	l := &recordingLoader{}
+	reg := NewRegistry(Config{MaxBatchSize: 2})
+
+	var chans []<-chan Result
+	for i := 0; i < 5; i++ {
+		chans = append(chans, reg.Enqueue(l, i))
+	}
+	reg.Dispatch(context.Background())
+
+	for i, ch := range chans {
+		if res := <-ch; res.Value != i {
+			t.Errorf("key %d: got value %v, want %d", i, res.Value, i)
+		}
+	}
+
+	calls := l.callCount()
+	if calls < 3 {
+		t.Errorf("BatchLoad called %d times, want at least 3 for 5 keys with MaxBatchSize 2", calls)
+	}
+	l.mu.Lock()
+	for _, keys := range l.calls {
+		if len(keys) > 2 {
+			t.Errorf("BatchLoad call got %d keys, want at most 2", len(keys))
+		}
+	}
+	l.mu.Unlock()
+}
+
+// TestSelfDispatchingCallerNeverMissesAnEnqueue mirrors the pattern
+// internal/exec.execFieldSelectionSelfDispatching uses: a resolver
+// goroutine may or may not enqueue a key against the Registry before
+// finishing, and a caller wants to call Dispatch exactly once, after the
+// goroutine has either enqueued or given up on ever doing so. Dispatching
+// as soon as the goroutine is merely started (rather than synchronizing on
+// one of those two outcomes) races the scheduler: if Dispatch wins, the key
+// ends up in the *next* pending batch with nothing left to ever dispatch
+// it, hanging the resolver on its result channel forever. Run with -race
+// and a high iteration count, this reproduces that hang virtually every
+// time if the synchronization is removed.
+func TestSelfDispatchingCallerNeverMissesAnEnqueue(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		l := &recordingLoader{}
+		reg := NewRegistry(Config{})
+
+		ready := make(chan struct{})
+		var readyOnce sync.Once
+		signalReady := func() { readyOnce.Do(func() { close(ready) }) }
+
+		resChan := make(chan Result, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer signalReady() // in case this resolver never reaches Enqueue
+			ch := reg.Enqueue(l, i)
+			signalReady()
+			resChan <- <-ch
+		}()
+
+		<-ready
+		reg.Dispatch(context.Background())
+		<-done
+
+		select {
+		case res := <-resChan:
+			if res.Value != i {
+				t.Fatalf("iteration %d: got value %v, want %d", i, res.Value, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("iteration %d: resolver never received its Result; Dispatch raced ahead of Enqueue", i)
+		}
+	}
+}
+
+func TestRegistryMaxWaitLetsLateEnqueueJoinBatch(t *testing.T) {
+	l := &recordingLoader{}
+	reg := NewRegistry(Config{MaxWait: 50 * time.Millisecond})
+
+	first := reg.Enqueue(l, "a")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		reg.Enqueue(l, "b")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		reg.Dispatch(context.Background())
+		close(done)
+	}()
+	<-done
+	<-first
+
+	if got := l.callCount(); got != 1 {
+		t.Errorf("BatchLoad called %d times, want 1 (the late key should have joined the same batch)", got)
+	}
+}
@@ -0,0 +1,177 @@
+// Package otel implements trace.Tracer on top of go.opentelemetry.io/otel,
+// giving every resolved field a real OTel span instead of the package's
+// built-in no-op/OpenTracing tracers.
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/placeybordeaux-remitly/graphql-go/errors"
+	"github.com/placeybordeaux-remitly/graphql-go/internal/introspection"
+)
+
+// AttributeFilter is called with each resolved field's packed argument
+// values before they're attached as span attributes, so callers can redact
+// or drop sensitive ones. Returning ok=false drops the argument entirely.
+type AttributeFilter func(name string, value interface{}) (redacted interface{}, ok bool)
+
+// Tracer implements trace.Tracer by creating one OTel span per resolved
+// field. Because the exec engine resolves sibling fields concurrently in
+// their own goroutines, which lose the parent span's implicit association,
+// Tracer injects the parent SpanContext into each field's context before
+// TraceField returns and records a Link back to it on the child span.
+type Tracer struct {
+	tracer oteltrace.Tracer
+	filter AttributeFilter
+}
+
+// NewTracer returns a Tracer that creates spans via tp. Pass
+// otel.GetTracerProvider() to use the global provider. filter may be nil,
+// in which case argument values are attached to spans unredacted.
+func NewTracer(tp oteltrace.TracerProvider, filter AttributeFilter) *Tracer {
+	return &Tracer{
+		tracer: tp.Tracer("github.com/placeybordeaux-remitly/graphql-go"),
+		filter: filter,
+	}
+}
+
+// TraceQuery wraps an entire operation's execution in a root span, so every
+// field span produced by TraceField below has something to nest under. It's
+// part of the trace.Tracer interface, called once per operation by the
+// top-level Schema.Exec before it hands off to internal/exec.Request.Execute
+// (or ExecuteIncremental) — the same call site trace.Tracer's other
+// implementations expect it from. That top-level package isn't part of this
+// tree, so there's no call site here to point at; TraceField below is the
+// only hook internal/exec itself invokes directly.
+func (t *Tracer) TraceQuery(ctx context.Context, queryString, operationName string, variables map[string]interface{}, varTypes map[string]*introspection.Type) (context.Context, func([]*errors.QueryError)) {
+	label := operationName
+	if label == "" {
+		label = "graphql.query"
+	}
+	ctx, span := t.tracer.Start(ctx, label, oteltrace.WithAttributes(
+		attribute.String("graphql.operation.name", operationName),
+		attribute.String("graphql.document", queryString),
+	))
+	return ctx, func(errs []*errors.QueryError) {
+		defer span.End()
+		if len(errs) == 0 {
+			return
+		}
+		span.SetStatus(codes.Error, errs[0].Error())
+		for _, err := range errs {
+			span.RecordError(err)
+		}
+	}
+}
+
+// TraceField starts a span for a single resolved field. Because execSelections
+// spawns one goroutine per async field, ctx here may not carry the span that
+// was current when the parent field's children were collected; it's passed
+// through regardless so the parent-child relationship via oteltrace's
+// context propagation still holds wherever ctx does carry it, and whenever
+// ctx carries a valid span a Link back to it is added as well (for serial
+// and async fields alike) so the two are still correlated in trace viewers
+// even when the span tree itself can't nest them.
+func (t *Tracer) TraceField(ctx context.Context, label, typeName, fieldName string, trivial bool, args map[string]interface{}) (context.Context, func(*errors.QueryError)) {
+	parent := oteltrace.SpanContextFromContext(ctx)
+
+	opts := []oteltrace.SpanStartOption{
+		oteltrace.WithAttributes(
+			attribute.String("graphql.field.name", fieldName),
+			attribute.String("graphql.field.type", typeName),
+			attribute.Bool("graphql.field.async", !trivial),
+		),
+	}
+	if parent.IsValid() {
+		opts = append(opts, oteltrace.WithLinks(oteltrace.Link{SpanContext: parent}))
+	}
+
+	spanCtx, span := t.tracer.Start(ctx, label, opts...)
+	path := pathAttr(ctx, fieldName)
+	span.SetAttributes(attribute.String("graphql.field.path", path))
+	// Stash the path this field resolved at onto the context TraceField
+	// returns, so a nested field's TraceField call (which is handed a ctx
+	// derived from this one, whether directly or via the parent-SpanContext
+	// link for an async sibling) builds on it instead of only ever seeing
+	// its own leaf name. This makes the full dotted path work out of the
+	// box without exec needing to call WithPath itself.
+	spanCtx = WithPath(spanCtx, path)
+
+	for name, value := range args {
+		if t.filter != nil {
+			var ok bool
+			value, ok = t.filter(name, value)
+			if !ok {
+				continue
+			}
+		}
+		span.SetAttributes(attribute.String("graphql.field.arg."+name, toString(value)))
+	}
+
+	return spanCtx, func(err *errors.QueryError) {
+		defer span.End()
+		if err == nil {
+			return
+		}
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+		err.Extensions = withTraceID(err.Extensions, span.SpanContext().TraceID().String())
+	}
+}
+
+// TraceBatch opens a span summarizing a single execList batch, recording
+// how many elements it resolved and how much of the request-wide limiter it
+// actually used, since list concurrency is capped below len(list) whenever
+// the limiter is smaller than the list.
+func (t *Tracer) TraceBatch(ctx context.Context, fieldName string, elementCount, concurrency int) (context.Context, func()) {
+	spanCtx, span := t.tracer.Start(ctx, fieldName+".batch", oteltrace.WithAttributes(
+		attribute.Int("graphql.list.count", elementCount),
+		attribute.Int("graphql.list.concurrency", concurrency),
+	))
+	return spanCtx, func() { span.End() }
+}
+
+func withTraceID(extensions map[string]interface{}, traceID string) map[string]interface{} {
+	if extensions == nil {
+		extensions = make(map[string]interface{}, 1)
+	}
+	extensions["traceId"] = traceID
+	return extensions
+}
+
+// pathAttr renders the dotted path for the field about to be traced: ctx's
+// parent field (if any) stashed its own path via WithPath when TraceField
+// returned it, so this just appends the current field's name to that. The
+// root field of an operation has no parent path stashed yet, so it falls
+// back to its own name. The path is built from field names, not aliases,
+// and has no list indices in it, so it differs from the response path for
+// aliased fields and for fields under a list.
+func pathAttr(ctx context.Context, fieldName string) string {
+	if v := ctx.Value(pathContextKey{}); v != nil {
+		if p, ok := v.(string); ok {
+			return p + "." + fieldName
+		}
+	}
+	return fieldName
+}
+
+type pathContextKey struct{}
+
+// WithPath attaches the dotted path of the field currently being resolved
+// to ctx, so the next TraceField call can set a full graphql.field.path
+// attribute instead of just the leaf field name.
+func WithPath(ctx context.Context, dottedPath string) context.Context {
+	return context.WithValue(ctx, pathContextKey{}, dottedPath)
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", v)
+}